@@ -0,0 +1,164 @@
+package storageconsul
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// DefaultArchivePrefix is where archived entries live relative to the
+// storage prefix when ArchiveOnDelete is enabled but ArchivePrefix is left
+// unset.
+const DefaultArchivePrefix = "archive"
+
+// archiveTimeFormat is used for the per-delete timestamp directory under
+// the archive prefix. It avoids ':' so the result is a clean path segment,
+// and sorts lexicographically the same as chronologically.
+const archiveTimeFormat = "20060102T150405.000000000Z"
+
+func (cs *ConsulStorage) archivePrefix() string {
+	prefix := cs.ArchivePrefix
+	if prefix == "" {
+		prefix = DefaultArchivePrefix
+	}
+	return strings.Trim(prefix, "/")
+}
+
+// isArchivePath reports whether rel (a key relative to the storage prefix)
+// falls under the archive prefix.
+func (cs *ConsulStorage) isArchivePath(rel string) bool {
+	archiveBase := cs.archivePrefix()
+	return rel == archiveBase || strings.HasPrefix(rel, archiveBase+"/")
+}
+
+// maxTxnOps is the largest number of operations Consul accepts in a single
+// KV transaction request (agent/txn_endpoint.go). archiveDelete batches
+// chunk moves below this cap so a chunked value with many chunks doesn't
+// make the whole transaction get rejected outright.
+const maxTxnOps = 128
+
+// archiveDelete moves key to <ArchivePrefix>/<timestamp>/<key> instead of
+// destroying it. The manifest/value itself is moved via a single Consul
+// transaction, so certmagic never observes a window where it exists at
+// neither the original nor the archived location. A chunked value's chunks
+// are moved first, in batches of at most maxTxnOps/2 (each chunk needs a
+// set and a delete), since a large bundle can have more chunks than fit in
+// one transaction; each batch is atomic, but the move as a whole across
+// batches is not, mirroring the (also not fully atomic) plain Delete path,
+// which likewise removes the chunk subtree before the key itself.
+func (cs *ConsulStorage) archiveDelete(ctx context.Context, key string, kvPair *consul.KVPair, chunkKeys []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	timestamp := time.Now().UTC().Format(archiveTimeFormat)
+	archiveKey := path.Join(cs.archivePrefix(), timestamp, key)
+
+	const chunksPerBatch = maxTxnOps / 2
+	for start := 0; start < len(chunkKeys); start += chunksPerBatch {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		end := start + chunksPerBatch
+		if end > len(chunkKeys) {
+			end = len(chunkKeys)
+		}
+
+		ops := make(consul.KVTxnOps, 0, 2*(end-start))
+		for _, chunk := range chunkKeys[start:end] {
+			chunkPair, _, err := cs.ConsulClient.KV().Get(chunk, nil)
+			if err != nil {
+				return fmt.Errorf("unable to load chunk %s for archiving: %w", chunk, err)
+			}
+			if chunkPair == nil {
+				continue
+			}
+
+			rel := strings.TrimPrefix(chunk, cs.prefixedKey("")+"/")
+			ops = append(ops,
+				&consul.KVTxnOp{
+					Verb:  consul.KVSet,
+					Key:   cs.prefixedKey(path.Join(cs.archivePrefix(), timestamp, rel)),
+					Value: chunkPair.Value,
+				},
+				&consul.KVTxnOp{
+					Verb: consul.KVDelete,
+					Key:  chunk,
+				},
+			)
+		}
+
+		if len(ops) == 0 {
+			continue
+		}
+
+		ok, resp, _, err := cs.ConsulClient.KV().Txn(ops, nil)
+		if err != nil {
+			return fmt.Errorf("unable to archive chunks for key %s: %w", key, err)
+		}
+		if !ok {
+			return fmt.Errorf("unable to archive chunks for key %s: transaction rejected: %v", key, resp.Errors)
+		}
+	}
+
+	ops := consul.KVTxnOps{
+		&consul.KVTxnOp{
+			Verb:  consul.KVSet,
+			Key:   cs.prefixedKey(archiveKey),
+			Value: kvPair.Value,
+		},
+		&consul.KVTxnOp{
+			Verb: consul.KVDelete,
+			Key:  cs.prefixedKey(key),
+		},
+	}
+
+	ok, resp, _, err := cs.ConsulClient.KV().Txn(ops, nil)
+	if err != nil {
+		return fmt.Errorf("unable to archive key %s: %w", key, err)
+	}
+	if !ok {
+		return fmt.Errorf("unable to archive key %s: transaction rejected: %v", key, resp.Errors)
+	}
+
+	return nil
+}
+
+// PruneArchive permanently deletes archived entries older than olderThan,
+// based on the timestamp directory they were archived under.
+func (cs *ConsulStorage) PruneArchive(ctx context.Context, olderThan time.Duration) error {
+	cutoff := time.Now().Add(-olderThan)
+	archiveRoot := cs.prefixedKey(cs.archivePrefix()) + "/"
+
+	dirs, _, err := cs.ConsulClient.KV().Keys(archiveRoot, "/", nil)
+	if err != nil {
+		return fmt.Errorf("unable to list archive directories: %w", err)
+	}
+
+	for _, dir := range dirs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		tsStr := strings.TrimSuffix(strings.TrimPrefix(dir, archiveRoot), "/")
+		ts, err := time.Parse(archiveTimeFormat, tsStr)
+		if err != nil {
+			// Not one of our timestamp directories; leave it alone.
+			continue
+		}
+		if ts.After(cutoff) {
+			continue
+		}
+
+		if _, err := cs.ConsulClient.KV().DeleteTree(dir, nil); err != nil {
+			return fmt.Errorf("unable to prune archive directory %s: %w", dir, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package storageconsul
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// ErrCASFailure is returned (via errors.Is) by CompareAndSwap and
+// StoreWithModifyIndex when the value in Consul no longer matches what the
+// caller expected, i.e. someone else won the race.
+var ErrCASFailure = errors.New("compare-and-swap failed: value was modified concurrently")
+
+// CompareAndSwap stores newValue at key only if the value currently there
+// still equals oldValue, using the key's Consul ModifyIndex under the hood
+// so the check-then-set is atomic even with two Caddy nodes racing for the
+// same key. Pass a nil oldValue to require that key doesn't exist yet.
+//
+// This does not support values large enough to have been chunked; such a
+// key will fail the comparison because the stored value is a chunk
+// manifest, never the plaintext cert.
+func (cs *ConsulStorage) CompareAndSwap(ctx context.Context, key string, oldValue, newValue []byte) error {
+	kvPair, _, err := cs.ConsulClient.KV().Get(cs.prefixedKey(key), nil)
+	if err != nil {
+		return fmt.Errorf("unable to load key %s for compare-and-swap: %w", key, err)
+	}
+
+	var modifyIndex uint64
+	switch {
+	case kvPair == nil && oldValue == nil:
+		// Nothing there yet, and nothing was expected: proceed with a CAS
+		// against index 0, which only succeeds if the key is still absent.
+	case kvPair == nil:
+		return fmt.Errorf("%w: key %s does not exist", ErrCASFailure, key)
+	default:
+		data, err := cs.DecryptStorageData(kvPair.Value)
+		if err != nil {
+			return fmt.Errorf("unable to decrypt existing value for key %s: %w", key, err)
+		}
+		if !bytes.Equal(data.Value, oldValue) {
+			return fmt.Errorf("%w: key %s", ErrCASFailure, key)
+		}
+		modifyIndex = kvPair.ModifyIndex
+	}
+
+	return cs.storeWithModifyIndex(ctx, key, newValue, modifyIndex)
+}
+
+// StoreWithModifyIndex stores value at key only if the key's current Consul
+// ModifyIndex still equals expectedIndex (e.g. the ModifyIndex of an Event
+// observed via Subscribe), failing with ErrCASFailure otherwise. Pass 0 to
+// require that the key doesn't exist yet.
+func (cs *ConsulStorage) StoreWithModifyIndex(ctx context.Context, key string, value []byte, expectedIndex uint64) error {
+	return cs.storeWithModifyIndex(ctx, key, value, expectedIndex)
+}
+
+func (cs *ConsulStorage) storeWithModifyIndex(ctx context.Context, key string, value []byte, expectedIndex uint64) error {
+	data := &StorageData{
+		Value:    value,
+		Modified: time.Now(),
+	}
+
+	encrypted, err := cs.EncryptStorageData(data)
+	if err != nil {
+		return fmt.Errorf("unable to encrypt data for key %s: %w", key, err)
+	}
+
+	if len(encrypted) > cs.chunkThreshold() {
+		return fmt.Errorf("key %s exceeds chunk_threshold and cannot be stored with an expected modify index", key)
+	}
+
+	ok, _, err := cs.ConsulClient.KV().CAS(&consul.KVPair{
+		Key:         cs.prefixedKey(key),
+		Value:       encrypted,
+		ModifyIndex: expectedIndex,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("unable to store key %s: %w", key, err)
+	}
+	if !ok {
+		return fmt.Errorf("%w: key %s", ErrCASFailure, key)
+	}
+
+	// This key may have previously held a chunked (over-threshold) value;
+	// since a CAS write always stores an under-threshold value, clean up
+	// any leftover chunk subtree the same way storeData does. Best-effort:
+	// failing to prune doesn't affect correctness, only tidiness.
+	_, _ = cs.ConsulClient.KV().DeleteTree(cs.prefixedKey(chunkSubtreePrefix(key)), nil)
+
+	return nil
+}
+
+// StoreBundle atomically writes several keys in a single Consul
+// transaction, e.g. a certificate, its private key and its JSON metadata,
+// which certmagic otherwise stores as three separate Store calls. Either
+// all of them land or none do. Bundled keys that would need chunking are
+// rejected rather than silently split across the transaction.
+func (cs *ConsulStorage) StoreBundle(ctx context.Context, values map[string][]byte) error {
+	ops := make(consul.KVTxnOps, 0, len(values))
+
+	now := time.Now()
+	for key, value := range values {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		encrypted, err := cs.EncryptStorageData(&StorageData{Value: value, Modified: now})
+		if err != nil {
+			return fmt.Errorf("unable to encrypt data for key %s: %w", key, err)
+		}
+		if len(encrypted) > cs.chunkThreshold() {
+			return fmt.Errorf("key %s exceeds chunk_threshold and cannot be part of an atomic bundle", key)
+		}
+
+		ops = append(ops, &consul.KVTxnOp{
+			Verb:  consul.KVSet,
+			Key:   cs.prefixedKey(key),
+			Value: encrypted,
+		})
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	ok, resp, _, err := cs.ConsulClient.KV().Txn(ops, nil)
+	if err != nil {
+		return fmt.Errorf("unable to store bundle: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("unable to store bundle: transaction rejected: %v", resp.Errors)
+	}
+
+	// Any of these keys may have previously held a chunked (over-threshold)
+	// value; since a bundle write always stores under-threshold values,
+	// clean up leftover chunk subtrees the same way storeData does.
+	// Best-effort: failing to prune doesn't affect correctness, only
+	// tidiness.
+	for key := range values {
+		_, _ = cs.ConsulClient.KV().DeleteTree(cs.prefixedKey(chunkSubtreePrefix(key)), nil)
+	}
+
+	return nil
+}
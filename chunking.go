@@ -0,0 +1,212 @@
+package storageconsul
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// Consul refuses KV values larger than 512 KiB. DefaultChunkThreshold is the
+// size (of the already-encrypted payload) above which Store transparently
+// splits a value into chunks, leaving headroom below that hard limit.
+const DefaultChunkThreshold = 400 * 1024
+
+// chunkSubtreeName is the path segment under which a chunked value's parts
+// are stored, e.g. "<key>/__chunks/0000". List hides this subtree from
+// recursive listings since it isn't a real certmagic key.
+const chunkSubtreeName = "__chunks"
+
+// chunkManifestMagic marks a StorageData.Value as holding a JSON
+// chunkManifest rather than real content, so Load/Stat can tell a chunked
+// entry apart from a normal one without a side channel.
+var chunkManifestMagic = []byte("caddy-consul-chunked-v1:")
+
+// chunkManifest is the small descriptor written at a chunked key's original
+// path; the actual content lives in the chunks it points at.
+type chunkManifest struct {
+	Chunks    int    `json:"chunks"`
+	TotalSize int    `json:"total_size"`
+	SHA256    string `json:"sha256"`
+}
+
+func (cs *ConsulStorage) chunkThreshold() int {
+	if cs.ChunkThreshold <= 0 {
+		return DefaultChunkThreshold
+	}
+	return cs.ChunkThreshold
+}
+
+func chunkKey(key string, index int) string {
+	return path.Join(key, chunkSubtreeName, fmt.Sprintf("%04d", index))
+}
+
+func chunkSubtreePrefix(key string) string {
+	return path.Join(key, chunkSubtreeName) + "/"
+}
+
+// isUnderChunkSubtree reports whether key (relative to the storage prefix)
+// falls under some other key's chunk subtree.
+func isUnderChunkSubtree(key string) bool {
+	for _, part := range strings.Split(key, "/") {
+		if part == chunkSubtreeName {
+			return true
+		}
+	}
+	return false
+}
+
+// storeChunked splits an already-encrypted payload into independently
+// re-encrypted chunks and writes a manifest at key describing how to
+// reassemble them. Chunks are written first and the manifest last, so a
+// reader never observes a manifest that points at chunks which aren't
+// there yet.
+func (cs *ConsulStorage) storeChunked(ctx context.Context, key string, encrypted []byte) error {
+	threshold := cs.chunkThreshold()
+	numChunks := (len(encrypted) + threshold - 1) / threshold
+	sum := sha256.Sum256(encrypted)
+
+	for i := 0; i < numChunks; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		start := i * threshold
+		end := start + threshold
+		if end > len(encrypted) {
+			end = len(encrypted)
+		}
+
+		chunkCiphertext, err := cs.encrypt(encrypted[start:end])
+		if err != nil {
+			return fmt.Errorf("unable to encrypt chunk %d for key %s: %w", i, key, err)
+		}
+
+		_, err = cs.ConsulClient.KV().Put(&consul.KVPair{
+			Key:   cs.prefixedKey(chunkKey(key, i)),
+			Value: chunkCiphertext,
+		}, nil)
+		if err != nil {
+			return fmt.Errorf("unable to store chunk %d for key %s: %w", i, key, err)
+		}
+	}
+
+	manifestJSON, err := json.Marshal(chunkManifest{
+		Chunks:    numChunks,
+		TotalSize: len(encrypted),
+		SHA256:    hex.EncodeToString(sum[:]),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to marshal chunk manifest for key %s: %w", key, err)
+	}
+
+	manifestEncrypted, err := cs.EncryptStorageData(&StorageData{
+		Value:    append(append([]byte{}, chunkManifestMagic...), manifestJSON...),
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to encrypt chunk manifest for key %s: %w", key, err)
+	}
+
+	if _, err := cs.ConsulClient.KV().Put(&consul.KVPair{
+		Key:   cs.prefixedKey(key),
+		Value: manifestEncrypted,
+	}, nil); err != nil {
+		return fmt.Errorf("unable to store chunk manifest for key %s: %w", key, err)
+	}
+
+	// Best-effort cleanup of chunks orphaned by a previous, larger version
+	// of this value; failing to prune them doesn't affect correctness.
+	cs.pruneOrphanChunks(key, numChunks)
+
+	return nil
+}
+
+func (cs *ConsulStorage) pruneOrphanChunks(key string, keep int) {
+	prefix := cs.prefixedKey(chunkSubtreePrefix(key))
+	keys, _, err := cs.ConsulClient.KV().Keys(prefix, "", nil)
+	if err != nil {
+		return
+	}
+	for _, k := range keys {
+		idx := strings.TrimPrefix(k, prefix)
+		var n int
+		if _, err := fmt.Sscanf(idx, "%04d", &n); err != nil || n < keep {
+			continue
+		}
+		_, _ = cs.ConsulClient.KV().Delete(k, nil)
+	}
+}
+
+// loadValue retrieves and fully decrypts the StorageData stored at key,
+// transparently reassembling it from chunks when the key holds a chunk
+// manifest. A missing manifest is reported as fs.ErrNotExist even if orphan
+// chunks are still present underneath it.
+func (cs *ConsulStorage) loadValue(ctx context.Context, key string) (*StorageData, error) {
+	kvPair, _, err := cs.ConsulClient.KV().Get(cs.prefixedKey(key), nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load value for key %s: %w", key, err)
+	}
+	if kvPair == nil {
+		return nil, fmt.Errorf("key %s: %w", key, fs.ErrNotExist)
+	}
+
+	data, err := cs.DecryptStorageData(kvPair.Value)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt data for key %s: %w", key, err)
+	}
+
+	if !bytes.HasPrefix(data.Value, chunkManifestMagic) {
+		return data, nil
+	}
+
+	var manifest chunkManifest
+	if err := json.Unmarshal(data.Value[len(chunkManifestMagic):], &manifest); err != nil {
+		return nil, fmt.Errorf("unable to parse chunk manifest for key %s: %w", key, err)
+	}
+
+	buf := make([]byte, 0, manifest.TotalSize)
+	for i := 0; i < manifest.Chunks; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		chunkPair, _, err := cs.ConsulClient.KV().Get(cs.prefixedKey(chunkKey(key, i)), nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load chunk %d for key %s: %w", i, key, err)
+		}
+		if chunkPair == nil {
+			return nil, fmt.Errorf("chunk %d for key %s: %w", i, key, fs.ErrNotExist)
+		}
+
+		plainChunk, err := cs.decrypt(chunkPair.Value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decrypt chunk %d for key %s: %w", i, key, err)
+		}
+
+		buf = append(buf, plainChunk...)
+	}
+
+	if len(buf) != manifest.TotalSize {
+		return nil, fmt.Errorf("chunk reassembly for key %s: expected %d bytes, got %d", key, manifest.TotalSize, len(buf))
+	}
+	sum := sha256.Sum256(buf)
+	if hex.EncodeToString(sum[:]) != manifest.SHA256 {
+		return nil, fmt.Errorf("chunk reassembly for key %s failed checksum verification", key)
+	}
+
+	reassembled, err := cs.DecryptStorageData(buf)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt reassembled value for key %s: %w", key, err)
+	}
+
+	return reassembled, nil
+}
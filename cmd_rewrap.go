@@ -0,0 +1,53 @@
+package storageconsul
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "consul-rewrap",
+		Func:  cmdConsulRewrap,
+		Usage: "[--config <path>]",
+		Short: "Re-encrypts all values in Consul KV storage through Vault Transit",
+		Long: `
+Walks every key under the configured storage prefix and re-encrypts it
+through Vault's transit/rewrap endpoint, without ever exposing plaintext
+to Caddy. Use this after rotating a Transit key so that old values are
+upgraded to the new key version.
+
+This subcommand requires the storage module to be configured with a
+Vault backend; without one it exits with an error.`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.RunE = caddycmd.WrapCommandFuncForCobra(cmdConsulRewrap)
+		},
+	})
+}
+
+func cmdConsulRewrap(fl caddycmd.Flags) (int, error) {
+	caddy.TrapSignals()
+
+	cs := New()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	if err := cs.Provision(ctx); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("unable to provision consul storage: %w", err)
+	}
+	defer cancel()
+
+	if cs.vault == nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("consul-rewrap requires a vault backend in the storage config")
+	}
+
+	if err := cs.RewrapVault(ctx); err != nil {
+		return 1, fmt.Errorf("rewrap failed: %w", err)
+	}
+
+	return caddy.ExitCodeSuccess, nil
+}
@@ -1,38 +1,73 @@
 package storageconsul
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 )
 
+// aesVersionedMagic marks a ciphertext produced by the versioned, multi-key
+// AES path (see encryptVersioned/decryptVersioned below). Blobs written
+// before key rotation was introduced have no such marker and are still
+// decrypted via the legacy single-AESKey path.
+//
+// This has to be a multi-byte string, not a single marker byte: a legacy
+// blob is just a GCM nonce followed by ciphertext, i.e. random bytes, and a
+// single-byte marker would misidentify about 1 in 256 legacy blobs as
+// versioned. A magic this long makes that collision a non-concern.
+var aesVersionedMagic = []byte("caddy-consul-aeskeys-v1:")
+
+// aesKeyIDSize is the width of the key ID that follows aesVersionedMagic in
+// a versioned blob.
+const aesKeyIDSize = 4
+
 func (cs *ConsulStorage) encrypt(bytes []byte) ([]byte, error) {
+	// Vault Transit takes precedence over the local AES key when configured.
+	if cs.vault != nil {
+		return cs.vault.encrypt(bytes)
+	}
+
+	if len(cs.AESKeys) > 0 {
+		return cs.encryptVersioned(bytes)
+	}
+
 	// No key? No encrypt
 	if len(cs.AESKey) == 0 {
 		return bytes, nil
 	}
 
-	c, err := aes.NewCipher(cs.AESKey)
-	if err != nil {
-		return nil, fmt.Errorf("unable to create AES cipher: %w", err)
-	}
+	return aesGCMSeal(cs.AESKey, bytes)
+}
 
-	gcm, err := cipher.NewGCM(c)
-	if err != nil {
-		return nil, fmt.Errorf("unable to create GCM cipher: %w", err)
+// encryptVersioned seals bytes under the active key from AESKeys, prefixing
+// the result with aesVersionedMagic and the key's ID so a future decrypt
+// knows which key to look up even after the active key has moved on.
+func (cs *ConsulStorage) encryptVersioned(bytes []byte) ([]byte, error) {
+	key, ok := cs.AESKeys[cs.AESActiveKey]
+	if !ok {
+		return nil, fmt.Errorf("aes_active_key %d is not present in aes_keys", cs.AESActiveKey)
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	_, err = io.ReadFull(rand.Reader, nonce)
+	sealed, err := aesGCMSeal(key, bytes)
 	if err != nil {
-		return nil, fmt.Errorf("unable to generate nonce: %w", err)
+		return nil, err
 	}
 
-	return gcm.Seal(nonce, nonce, bytes, nil), nil
+	out := make([]byte, 0, len(aesVersionedMagic)+aesKeyIDSize+len(sealed))
+	out = append(out, aesVersionedMagic...)
+	idBuf := make([]byte, aesKeyIDSize)
+	binary.BigEndian.PutUint32(idBuf, cs.AESActiveKey)
+	out = append(out, idBuf...)
+	out = append(out, sealed...)
+
+	return out, nil
 }
 
 func (cs *ConsulStorage) EncryptStorageData(data *StorageData) ([]byte, error) {
@@ -48,15 +83,92 @@ func (cs *ConsulStorage) EncryptStorageData(data *StorageData) ([]byte, error) {
 }
 
 func (cs *ConsulStorage) decrypt(bytes []byte) ([]byte, error) {
+	// Vault Transit takes precedence over the local AES key when configured.
+	if cs.vault != nil {
+		return cs.vault.decrypt(bytes)
+	}
+
+	if len(cs.AESKeys) > 0 {
+		return cs.decryptVersioned(bytes)
+	}
+
 	// No key? No decrypt
 	if len(cs.AESKey) == 0 {
 		return bytes, nil
 	}
+
+	return aesGCMOpen(cs.AESKey, bytes)
+}
+
+// decryptVersioned handles both blobs written under the versioned, multi-key
+// scheme and legacy blobs written before key rotation existed. A legacy
+// blob has no aesVersionedMagic prefix and is opened directly with the
+// (single, pre-rotation) AESKey, so upgrading a config to aes_keys never
+// strands already-stored certificates.
+func (cs *ConsulStorage) decryptVersioned(bytes []byte) ([]byte, error) {
+	magicLen := len(aesVersionedMagic)
+	if len(bytes) >= magicLen+aesKeyIDSize && string(bytes[:magicLen]) == string(aesVersionedMagic) {
+		keyID := binary.BigEndian.Uint32(bytes[magicLen : magicLen+aesKeyIDSize])
+		key, ok := cs.AESKeys[keyID]
+		if !ok {
+			return nil, fmt.Errorf("aes key id %d has been retired and is no longer configured", keyID)
+		}
+		return aesGCMOpen(key, bytes[magicLen+aesKeyIDSize:])
+	}
+
+	// No aesVersionedMagic prefix: this predates key rotation.
+	if len(cs.AESKey) == 0 {
+		return nil, errors.New("found legacy unversioned ciphertext but no aes_key is configured to decrypt it")
+	}
+	return aesGCMOpen(cs.AESKey, bytes)
+}
+
+func (cs *ConsulStorage) DecryptStorageData(bytes []byte) (*StorageData, error) {
+	// We have to decrypt if there is an AES key and then JSON unmarshal
+	bytes, err := cs.decrypt(bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt data: %w", err)
+	}
+
+	// Simple sanity check of the beginning of the byte array just to check
+	if len(bytes) < len(cs.ValuePrefix) || string(bytes[:len(cs.ValuePrefix)]) != cs.ValuePrefix {
+		return nil, errors.New("invalid data format")
+	}
+
+	// Now just json unmarshal
+	data := &StorageData{}
+	if err := json.Unmarshal(bytes[len(cs.ValuePrefix):], data); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal result: %w", err)
+	}
+	return data, nil
+}
+
+func aesGCMSeal(key, plaintext []byte) ([]byte, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create AES cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create GCM cipher: %w", err)
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate nonce: %w", err)
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func aesGCMOpen(key, bytes []byte) ([]byte, error) {
 	if len(bytes) < aes.BlockSize {
 		return nil, errors.New("invalid contents")
 	}
 
-	block, err := aes.NewCipher(cs.AESKey)
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create AES cipher: %w", err)
 	}
@@ -74,22 +186,47 @@ func (cs *ConsulStorage) decrypt(bytes []byte) ([]byte, error) {
 	return out, nil
 }
 
-func (cs *ConsulStorage) DecryptStorageData(bytes []byte) (*StorageData, error) {
-	// We have to decrypt if there is an AES key and then JSON unmarshal
-	bytes, err := cs.decrypt(bytes)
+// Rewrap re-encrypts every value under the storage prefix with the active
+// AES key (or the active Vault Transit key, which handles its own rewrap
+// path without ever seeing plaintext -- see RewrapVault). This is the
+// operational half of key rotation: once aes_active_key points at a new
+// key, Rewrap upgrades existing values so the retired key can eventually be
+// removed from aes_keys.
+//
+// Lock markers (.lock) and chunk fragments (__chunks/NNNN) are skipped:
+// neither carries a StorageData envelope, so classifying them the same way
+// List does -- rather than trying to decrypt them -- lets the sweep get
+// past any tree that has ever held a lock or a chunked value. A failure on
+// one key is recorded and the sweep continues, so one bad key can't stop
+// the rest of the prefix from being rotated.
+func (cs *ConsulStorage) Rewrap(ctx context.Context) error {
+	basePrefix := cs.Prefix + "/"
+	keys, _, err := cs.ConsulClient.KV().Keys(basePrefix, "", nil)
 	if err != nil {
-		return nil, fmt.Errorf("unable to decrypt data: %w", err)
+		return fmt.Errorf("unable to list keys under %s: %w", cs.Prefix, err)
 	}
 
-	// Simple sanity check of the beginning of the byte array just to check
-	if len(bytes) < len(cs.ValuePrefix) || string(bytes[:len(cs.ValuePrefix)]) != cs.ValuePrefix {
-		return nil, errors.New("invalid data format")
+	var errs []error
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel := strings.TrimPrefix(key, basePrefix)
+		if isLockKey(rel) || isUnderChunkSubtree(rel) {
+			continue
+		}
+
+		data, err := cs.loadValue(ctx, rel)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to load %s: %w", rel, err))
+			continue
+		}
+
+		if err := cs.storeData(ctx, rel, data); err != nil {
+			errs = append(errs, fmt.Errorf("unable to rewrap %s: %w", rel, err))
+		}
 	}
 
-	// Now just json unmarshal
-	data := &StorageData{}
-	if err := json.Unmarshal(bytes[len(cs.ValuePrefix):], data); err != nil {
-		return nil, fmt.Errorf("unable to unmarshal result: %w", err)
-	}
-	return data, nil
+	return errors.Join(errs...)
 }
@@ -0,0 +1,530 @@
+package storageconsul
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	consul "github.com/hashicorp/consul/api"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(&ConsulStorage{})
+}
+
+// Environment variable names used to configure the storage module without
+// having to put secrets in the Caddyfile.
+const (
+	EnvNamePrefix = "CADDY_CLUSTERING_CONSUL_PREFIX"
+	EnvNameAESKey = "CADDY_CLUSTERING_CONSUL_AESKEY"
+
+	DefaultPrefix  = "caddytls"
+	DefaultLockTTL = 15 * time.Second
+)
+
+// StorageData describes the envelope that is actually persisted in Consul
+// for every key. It is JSON-marshaled and then (optionally) encrypted before
+// being written as the value of a KV pair.
+type StorageData struct {
+	Value    []byte    `json:"value"`
+	Modified time.Time `json:"modified"`
+}
+
+// ConsulStorage implements certmagic.Storage (and the Caddy storage module
+// interface) backed by a Consul KV store.
+type ConsulStorage struct {
+	logger *zap.SugaredLogger
+
+	Address     string `json:"address,omitempty"`
+	Token       string `json:"token,omitempty"`
+	Prefix      string `json:"prefix,omitempty"`
+	ValuePrefix string `json:"value_prefix,omitempty"`
+	AESKey      []byte `json:"aes_key,omitempty"`
+	LockTimeout string `json:"lock_timeout,omitempty"`
+
+	// AESKeys and AESActiveKey support versioned key rotation: encrypt
+	// always uses AESKeys[AESActiveKey], while decrypt looks the blob's
+	// key ID up in AESKeys so retired keys can still read older values
+	// until they are explicitly removed. AESKey above remains the legacy
+	// single-key path used for blobs written before rotation was enabled.
+	AESKeys      map[uint32][]byte `json:"aes_keys,omitempty"`
+	AESActiveKey uint32            `json:"aes_active_key,omitempty"`
+
+	// ChunkThreshold is the size, in bytes, of the encrypted payload above
+	// which Store transparently splits a value into chunks to stay under
+	// Consul's 512 KiB KV value limit. Defaults to DefaultChunkThreshold.
+	ChunkThreshold int `json:"chunk_threshold,omitempty"`
+
+	// ArchiveOnDelete, when true, makes Delete move a key under
+	// ArchivePrefix instead of destroying it, so revoked or superseded
+	// certificates stay available for post-mortem/audit.
+	ArchiveOnDelete bool `json:"archive_on_delete,omitempty"`
+	// ArchivePrefix is where archived entries live, relative to Prefix.
+	// Defaults to DefaultArchivePrefix.
+	ArchivePrefix string `json:"archive_prefix,omitempty"`
+
+	// Vault is the optional configuration for delegating encryption to a
+	// HashiCorp Vault Transit secrets engine instead of AESKey. When set,
+	// it takes precedence over AESKey for both encrypt and decrypt.
+	Vault *VaultConfig `json:"vault,omitempty"`
+
+	ConsulClient *consul.Client `json:"-"`
+
+	vault *vaultTransit
+
+	locks   map[string]*consul.Lock
+	muLocks sync.RWMutex
+}
+
+// CaddyModule returns the Caddy module information.
+func (*ConsulStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.storage.consul",
+		New: func() caddy.Module { return New() },
+	}
+}
+
+// New creates a ConsulStorage with the defaults set.
+func New() *ConsulStorage {
+	return &ConsulStorage{
+		Prefix: DefaultPrefix,
+		locks:  make(map[string]*consul.Lock),
+	}
+}
+
+// CertMagicStorage converts cs to a certmagic.Storage instance.
+func (cs *ConsulStorage) CertMagicStorage() (certmagic.Storage, error) {
+	return cs, nil
+}
+
+// Provision sets up the module, reading any unset configuration from the
+// environment and building the underlying Consul client.
+func (cs *ConsulStorage) Provision(ctx caddy.Context) error {
+	cs.logger = ctx.Logger().Sugar()
+
+	if cs.Prefix == "" {
+		cs.Prefix = DefaultPrefix
+	}
+	if prefix := os.Getenv(EnvNamePrefix); prefix != "" {
+		cs.Prefix = prefix
+	}
+
+	if len(cs.AESKey) == 0 {
+		if key := os.Getenv(EnvNameAESKey); key != "" {
+			cs.AESKey = []byte(key)
+		}
+	}
+
+	config := consul.DefaultConfig()
+	if cs.Address != "" {
+		config.Address = cs.Address
+	}
+	if cs.Token != "" {
+		config.Token = cs.Token
+	}
+
+	client, err := consul.NewClient(config)
+	if err != nil {
+		return fmt.Errorf("unable to create consul client: %w", err)
+	}
+	cs.ConsulClient = client
+
+	if cs.locks == nil {
+		cs.locks = make(map[string]*consul.Lock)
+	}
+
+	if cs.Vault != nil {
+		vt, err := newVaultTransit(ctx, cs.Vault, cs.logger)
+		if err != nil {
+			return fmt.Errorf("unable to set up vault transit backend: %w", err)
+		}
+		cs.vault = vt
+	}
+
+	return nil
+}
+
+func (cs *ConsulStorage) lockTimeout() time.Duration {
+	if cs.LockTimeout == "" {
+		return DefaultLockTTL
+	}
+	d, err := time.ParseDuration(cs.LockTimeout)
+	if err != nil {
+		return DefaultLockTTL
+	}
+	return d
+}
+
+func (cs *ConsulStorage) prefixedKey(key string) string {
+	return path.Join(cs.Prefix, key)
+}
+
+// isLockKey reports whether key (relative to the storage prefix) is a
+// distributed-lock marker written by Lock/Unlock rather than real stored
+// data. Its value is always empty, so it can't be decrypted as StorageData.
+func isLockKey(key string) bool {
+	return path.Base(key) == ".lock"
+}
+
+// Store saves the given value at the given key, transparently chunking it
+// if the encrypted payload is too large for a single Consul KV value.
+func (cs *ConsulStorage) Store(ctx context.Context, key string, value []byte) error {
+	return cs.storeData(ctx, key, &StorageData{
+		Value:    value,
+		Modified: time.Now(),
+	})
+}
+
+// storeData writes data at key, transparently chunking it if the encrypted
+// payload is too large for a single Consul KV value.
+func (cs *ConsulStorage) storeData(ctx context.Context, key string, data *StorageData) error {
+	encrypted, err := cs.EncryptStorageData(data)
+	if err != nil {
+		return fmt.Errorf("unable to encrypt data for key %s: %w", key, err)
+	}
+
+	if len(encrypted) > cs.chunkThreshold() {
+		return cs.storeChunked(ctx, key, encrypted)
+	}
+
+	kvPair := &consul.KVPair{
+		Key:   cs.prefixedKey(key),
+		Value: encrypted,
+	}
+
+	if _, err := cs.ConsulClient.KV().Put(kvPair, nil); err != nil {
+		return fmt.Errorf("unable to store value for key %s: %w", key, err)
+	}
+
+	// This key may have previously held a chunked (over-threshold) value;
+	// since it no longer does, clean up any leftover chunk subtree so it
+	// doesn't leak KV storage indefinitely. Best-effort, like
+	// pruneOrphanChunks: failing to prune doesn't affect correctness, only
+	// tidiness.
+	_, _ = cs.ConsulClient.KV().DeleteTree(cs.prefixedKey(chunkSubtreePrefix(key)), nil)
+
+	return nil
+}
+
+// Load retrieves the value at the given key, reassembling it first if it
+// was chunked.
+func (cs *ConsulStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	data, err := cs.loadValue(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return data.Value, nil
+}
+
+// Delete removes the value at the given key, along with its chunk subtree
+// if it was chunked. If ArchiveOnDelete is set, the value is moved under
+// ArchivePrefix instead of being destroyed.
+func (cs *ConsulStorage) Delete(ctx context.Context, key string) error {
+	kvPair, _, err := cs.ConsulClient.KV().Get(cs.prefixedKey(key), nil)
+	if err != nil {
+		return fmt.Errorf("unable to load key %s for deletion: %w", key, err)
+	}
+
+	var chunked bool
+	if kvPair != nil {
+		if data, derr := cs.DecryptStorageData(kvPair.Value); derr == nil && bytes.HasPrefix(data.Value, chunkManifestMagic) {
+			chunked = true
+		}
+	}
+
+	if cs.ArchiveOnDelete && kvPair != nil {
+		var chunkKeys []string
+		if chunked {
+			keys, _, err := cs.ConsulClient.KV().Keys(cs.prefixedKey(chunkSubtreePrefix(key)), "", nil)
+			if err != nil {
+				return fmt.Errorf("unable to list chunks for key %s: %w", key, err)
+			}
+			chunkKeys = keys
+		}
+		return cs.archiveDelete(ctx, key, kvPair, chunkKeys)
+	}
+
+	if chunked {
+		if _, err := cs.ConsulClient.KV().DeleteTree(cs.prefixedKey(chunkSubtreePrefix(key)), nil); err != nil {
+			return fmt.Errorf("unable to delete chunk subtree for key %s: %w", key, err)
+		}
+	}
+
+	_, err = cs.ConsulClient.KV().Delete(cs.prefixedKey(key), nil)
+	if err != nil {
+		return fmt.Errorf("unable to delete key %s: %w", key, err)
+	}
+	return nil
+}
+
+// Exists returns true if the given key exists.
+func (cs *ConsulStorage) Exists(ctx context.Context, key string) bool {
+	kvPair, _, err := cs.ConsulClient.KV().Get(cs.prefixedKey(key), nil)
+	if err != nil || kvPair == nil {
+		return false
+	}
+	return true
+}
+
+// List returns all keys stored under prefix, optionally recursively.
+func (cs *ConsulStorage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	listPrefix := cs.prefixedKey(prefix)
+	if !strings.HasSuffix(listPrefix, "/") {
+		listPrefix += "/"
+	}
+
+	keys, _, err := cs.ConsulClient.KV().Keys(listPrefix, "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list keys under %s: %w", prefix, err)
+	}
+
+	browsingArchive := cs.isArchivePath(strings.Trim(prefix, "/"))
+
+	basePrefix := cs.Prefix + "/"
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		rel := strings.TrimPrefix(k, basePrefix)
+		if isUnderChunkSubtree(rel) {
+			continue
+		}
+		if !browsingArchive && cs.isArchivePath(rel) {
+			continue
+		}
+		if !recursive {
+			remainder := strings.TrimPrefix(rel, prefix+"/")
+			parts := strings.SplitN(remainder, "/", 2)
+			rel = path.Join(prefix, parts[0])
+		}
+		seen[rel] = true
+	}
+
+	result := make([]string, 0, len(seen))
+	for k := range seen {
+		result = append(result, k)
+	}
+
+	if len(result) == 0 {
+		return nil, fs.ErrNotExist
+	}
+
+	return result, nil
+}
+
+// Stat returns key info for the given key, reporting the reassembled size
+// if the key was chunked.
+func (cs *ConsulStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	data, err := cs.loadValue(ctx, key)
+	if err != nil {
+		return certmagic.KeyInfo{}, err
+	}
+
+	return certmagic.KeyInfo{
+		Key:        key,
+		Modified:   data.Modified,
+		Size:       int64(len(data.Value)),
+		IsTerminal: true,
+	}, nil
+}
+
+// Lock acquires a distributed lock for the given key.
+func (cs *ConsulStorage) Lock(ctx context.Context, key string) error {
+	lockKey := path.Join(cs.prefixedKey(key), ".lock")
+
+	cs.muLocks.Lock()
+	lock, ok := cs.locks[lockKey]
+	if !ok {
+		var err error
+		lock, err = cs.ConsulClient.LockOpts(&consul.LockOptions{
+			Key: lockKey,
+		})
+		if err != nil {
+			cs.muLocks.Unlock()
+			return fmt.Errorf("unable to create lock for key %s: %w", key, err)
+		}
+		cs.locks[lockKey] = lock
+	}
+	cs.muLocks.Unlock()
+
+	_, err := lock.Lock(ctx.Done())
+	if err != nil {
+		return fmt.Errorf("unable to acquire lock for key %s: %w", key, err)
+	}
+
+	return nil
+}
+
+// Unlock releases the distributed lock for the given key.
+func (cs *ConsulStorage) Unlock(ctx context.Context, key string) error {
+	lockKey := path.Join(cs.prefixedKey(key), ".lock")
+
+	cs.muLocks.RLock()
+	lock, ok := cs.locks[lockKey]
+	cs.muLocks.RUnlock()
+	if !ok {
+		return fmt.Errorf("no lock held for key %s", key)
+	}
+
+	if err := lock.Unlock(); err != nil {
+		return fmt.Errorf("unable to release lock for key %s: %w", key, err)
+	}
+
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the storage module from Caddyfile tokens.
+func (cs *ConsulStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "address":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				cs.Address = d.Val()
+			case "token":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				cs.Token = d.Val()
+			case "prefix":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				cs.Prefix = d.Val()
+			case "value_prefix":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				cs.ValuePrefix = d.Val()
+			case "aes_key":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				cs.AESKey = []byte(d.Val())
+			case "aes_keys":
+				if cs.AESKeys == nil {
+					cs.AESKeys = make(map[uint32][]byte)
+				}
+				for d.NextBlock(1) {
+					id, err := strconv.ParseUint(d.Val(), 10, 32)
+					if err != nil {
+						return d.Errf("invalid aes_keys id %q: %v", d.Val(), err)
+					}
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					key, err := hex.DecodeString(d.Val())
+					if err != nil {
+						return d.Errf("invalid aes_keys hex value for id %d: %v", id, err)
+					}
+					cs.AESKeys[uint32(id)] = key
+				}
+			case "aes_active_key":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				id, err := strconv.ParseUint(d.Val(), 10, 32)
+				if err != nil {
+					return d.Errf("invalid aes_active_key %q: %v", d.Val(), err)
+				}
+				cs.AESActiveKey = uint32(id)
+			case "chunk_threshold":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				threshold, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid chunk_threshold %q: %v", d.Val(), err)
+				}
+				cs.ChunkThreshold = threshold
+			case "archive_on_delete":
+				cs.ArchiveOnDelete = true
+			case "archive_prefix":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				cs.ArchivePrefix = d.Val()
+			case "lock_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				cs.LockTimeout = d.Val()
+			case "vault":
+				vc := &VaultConfig{}
+				for d.NextBlock(1) {
+					switch d.Val() {
+					case "address":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						vc.Address = d.Val()
+					case "auth_method":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						vc.AuthMethod = VaultAuthMethod(d.Val())
+					case "token":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						vc.Token = d.Val()
+					case "approle_mount":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						vc.AppRoleMount = d.Val()
+					case "kubernetes_role":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						vc.KubernetesRole = d.Val()
+					case "kubernetes_mount":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						vc.KubernetesMount = d.Val()
+					case "transit_mount":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						vc.TransitMount = d.Val()
+					case "key_name":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						vc.KeyName = d.Val()
+					case "context":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						vc.Context = d.Val()
+					default:
+						return d.ArgErr()
+					}
+				}
+				cs.Vault = vc
+			default:
+				return d.ArgErr()
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	_ certmagic.Storage = (*ConsulStorage)(nil)
+	_ caddy.Provisioner = (*ConsulStorage)(nil)
+	_ caddy.Module      = (*ConsulStorage)(nil)
+)
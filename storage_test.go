@@ -105,6 +105,45 @@ func TestConsulStorage_Delete(t *testing.T) {
 	assert.ErrorIs(t, err, fs.ErrNotExist)
 }
 
+func TestConsulStorage_ArchiveOnDelete(t *testing.T) {
+	cs := setupConsulEnv(t)
+	cs.ArchiveOnDelete = true
+
+	key := path.Join("acme", "example.com", "sites", "example.com", "example.com.crt")
+	keptKey := path.Join("acme", "example.com", "sites", "example.com", "example.com.key")
+	content := []byte("crt data")
+
+	err := cs.Store(context.Background(), key, content)
+	assert.NoError(t, err)
+	err = cs.Store(context.Background(), keptKey, []byte("key data"))
+	assert.NoError(t, err)
+
+	err = cs.Delete(context.Background(), key)
+	assert.NoError(t, err)
+
+	exists := cs.Exists(context.Background(), key)
+	assert.False(t, exists)
+
+	contentLoaded, err := cs.Load(context.Background(), key)
+	assert.Nil(t, contentLoaded)
+	assert.Error(t, err)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// The value is still discoverable under the archive prefix...
+	archived, err := cs.List(context.Background(), cs.archivePrefix(), true)
+	assert.NoError(t, err)
+	assert.Len(t, archived, 1)
+
+	archivedContent, err := cs.Load(context.Background(), archived[0])
+	assert.NoError(t, err)
+	assert.Equal(t, content, archivedContent)
+
+	// ...but excluded from a normal listing of the original prefix.
+	normalListing, err := cs.List(context.Background(), "", true)
+	assert.NoError(t, err)
+	assert.NotContains(t, normalListing, archived[0])
+}
+
 func TestConsulStorage_Stat(t *testing.T) {
 	cs := setupConsulEnv(t)
 
@@ -164,6 +203,42 @@ func TestConsulStorage_LockUnlock(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestConsulStorage_ChunkedStore(t *testing.T) {
+	cs := setupConsulEnv(t)
+	cs.ChunkThreshold = 1024
+
+	key := path.Join("acme", "example.com", "sites", "example.com", "example.com.crt")
+	content := make([]byte, 10*1024)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	err := cs.Store(context.Background(), key, content)
+	assert.NoError(t, err)
+
+	loaded, err := cs.Load(context.Background(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, content, loaded)
+
+	info, err := cs.Stat(context.Background(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size)
+
+	keys, err := cs.List(context.Background(), path.Join("acme", "example.com", "sites", "example.com"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{key}, keys)
+
+	err = cs.Delete(context.Background(), key)
+	assert.NoError(t, err)
+
+	exists := cs.Exists(context.Background(), key)
+	assert.False(t, exists)
+
+	chunks, _, err := cs.ConsulClient.KV().Keys(cs.prefixedKey(chunkSubtreePrefix(key)), "", nil)
+	assert.NoError(t, err)
+	assert.Empty(t, chunks)
+}
+
 func TestConsulStorage_TwoLocks(t *testing.T) {
 	cs := setupConsulEnv(t)
 	cs2 := setupConsulEnv(t)
@@ -183,3 +258,162 @@ func TestConsulStorage_TwoLocks(t *testing.T) {
 	err = cs2.Unlock(context.Background(), lockKey)
 	assert.NoError(t, err)
 }
+
+func TestConsulStorage_CompareAndSwap_ContendingWriters(t *testing.T) {
+	cs := setupConsulEnv(t)
+
+	key := path.Join("acme", "example.com", "sites", "example.com", "example.com.json")
+	original := []byte(`{"version":1}`)
+
+	err := cs.Store(context.Background(), key, original)
+	assert.NoError(t, err)
+
+	// Both writers read the same starting value...
+	err = cs.CompareAndSwap(context.Background(), key, original, []byte(`{"version":2}`))
+	assert.NoError(t, err)
+
+	// ...but the loser's compare-and-swap is rejected with ErrCASFailure
+	// instead of silently clobbering the winner's write.
+	err = cs.CompareAndSwap(context.Background(), key, original, []byte(`{"version":3}`))
+	assert.Error(t, err)
+	assert.ErrorIs(t, err, ErrCASFailure)
+
+	loaded, err := cs.Load(context.Background(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(`{"version":2}`), loaded)
+}
+
+func TestConsulStorage_StoreBundle(t *testing.T) {
+	cs := setupConsulEnv(t)
+
+	certKey := path.Join("acme", "example.com", "sites", "example.com", "example.com.crt")
+	keyKey := path.Join("acme", "example.com", "sites", "example.com", "example.com.key")
+	metaKey := path.Join("acme", "example.com", "sites", "example.com", "example.com.json")
+
+	err := cs.StoreBundle(context.Background(), map[string][]byte{
+		certKey: []byte("crt data"),
+		keyKey:  []byte("key data"),
+		metaKey: []byte(`{"version":1}`),
+	})
+	assert.NoError(t, err)
+
+	crt, err := cs.Load(context.Background(), certKey)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), crt)
+
+	key, err := cs.Load(context.Background(), keyKey)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("key data"), key)
+
+	meta, err := cs.Load(context.Background(), metaKey)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(`{"version":1}`), meta)
+}
+
+func TestConsulStorage_StoreBundle_PrunesOrphanChunks(t *testing.T) {
+	cs := setupConsulEnv(t)
+	cs.ChunkThreshold = 1024
+
+	key := path.Join("acme", "example.com", "sites", "example.com", "example.com.crt")
+	big := make([]byte, 10*1024)
+	for i := range big {
+		big[i] = byte(i % 251)
+	}
+
+	err := cs.Store(context.Background(), key, big)
+	assert.NoError(t, err)
+
+	err = cs.StoreBundle(context.Background(), map[string][]byte{
+		key: []byte("small now"),
+	})
+	assert.NoError(t, err)
+
+	loaded, err := cs.Load(context.Background(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("small now"), loaded)
+
+	chunks, _, err := cs.ConsulClient.KV().Keys(cs.prefixedKey(chunkSubtreePrefix(key)), "", nil)
+	assert.NoError(t, err)
+	assert.Empty(t, chunks)
+}
+
+func TestConsulStorage_PruneArchive(t *testing.T) {
+	cs := setupConsulEnv(t)
+	cs.ArchiveOnDelete = true
+
+	key := path.Join("acme", "example.com", "sites", "example.com", "example.com.crt")
+	content := []byte("crt data")
+
+	err := cs.Store(context.Background(), key, content)
+	assert.NoError(t, err)
+	err = cs.Delete(context.Background(), key)
+	assert.NoError(t, err)
+
+	archived, err := cs.List(context.Background(), cs.archivePrefix(), true)
+	assert.NoError(t, err)
+	assert.Len(t, archived, 1)
+
+	// A cutoff an hour back: the entry was archived after it, so nothing is
+	// old enough to prune yet.
+	err = cs.PruneArchive(context.Background(), time.Hour)
+	assert.NoError(t, err)
+
+	archived, err = cs.List(context.Background(), cs.archivePrefix(), true)
+	assert.NoError(t, err)
+	assert.Len(t, archived, 1)
+
+	// A zero cutoff: everything archived so far already is "older than
+	// now" and gets permanently removed.
+	err = cs.PruneArchive(context.Background(), 0)
+	assert.NoError(t, err)
+
+	_, err = cs.List(context.Background(), cs.archivePrefix(), true)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestConsulStorage_Subscribe(t *testing.T) {
+	cs := setupConsulEnv(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	events, err := cs.Subscribe(ctx, "acme")
+	assert.NoError(t, err)
+
+	key := path.Join("acme", "example.com", "sites", "example.com", "example.com.crt")
+
+	err = cs.Store(context.Background(), key, []byte("v1"))
+	assert.NoError(t, err)
+	ev := waitForEvent(t, events, EventCreate)
+	assert.Contains(t, ev.Key, key)
+
+	err = cs.Store(context.Background(), key, []byte("v2"))
+	assert.NoError(t, err)
+	ev = waitForEvent(t, events, EventUpdate)
+	assert.Contains(t, ev.Key, key)
+
+	err = cs.Delete(context.Background(), key)
+	assert.NoError(t, err)
+	ev = waitForEvent(t, events, EventDelete)
+	assert.Contains(t, ev.Key, key)
+}
+
+// waitForEvent drains events until one of type want arrives, failing the
+// test if none shows up within a reasonable time.
+func waitForEvent(t *testing.T, events <-chan Event, want EventType) Event {
+	t.Helper()
+	timeout := time.After(20 * time.Second)
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				t.Fatalf("event channel closed while waiting for a %s event", want)
+			}
+			if ev.Type == want {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for a %s event", want)
+		}
+	}
+}
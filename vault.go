@@ -0,0 +1,385 @@
+package storageconsul
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	consul "github.com/hashicorp/consul/api"
+	vault "github.com/hashicorp/vault/api"
+	"go.uber.org/zap"
+)
+
+// VaultAuthMethod selects how the storage module authenticates against
+// Vault before talking to the Transit secrets engine.
+type VaultAuthMethod string
+
+const (
+	VaultAuthToken      VaultAuthMethod = "token"
+	VaultAuthAppRole    VaultAuthMethod = "approle"
+	VaultAuthKubernetes VaultAuthMethod = "kubernetes"
+)
+
+// Environment variables consulted for AppRole credentials, following the
+// convention already used for the Consul ACL token and AES key.
+const (
+	EnvNameVaultRoleID   = "VAULT_ROLE_ID"
+	EnvNameVaultSecretID = "VAULT_SECRET_ID"
+)
+
+// kubernetesJWTPath is where the Kubernetes service account token is
+// projected into the pod by default.
+const kubernetesJWTPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// VaultConfig configures the optional Vault Transit encryption backend.
+// When set on ConsulStorage it replaces the local AES-GCM path for
+// EncryptStorageData/DecryptStorageData.
+type VaultConfig struct {
+	Address string `json:"address,omitempty"`
+
+	AuthMethod VaultAuthMethod `json:"auth_method,omitempty"`
+
+	// Token is used as-is when AuthMethod is "token". It may also be left
+	// empty in favor of the VAULT_TOKEN environment variable.
+	Token string `json:"token,omitempty"`
+
+	// AppRoleMount is the mount path of the AppRole auth method (defaults
+	// to "approle"); role_id/secret_id are read from
+	// VAULT_ROLE_ID/VAULT_SECRET_ID so they never need to live in the
+	// Caddyfile.
+	AppRoleMount string `json:"approle_mount,omitempty"`
+
+	// KubernetesRole is the Vault role bound to the pod's service account
+	// when AuthMethod is "kubernetes".
+	KubernetesRole  string `json:"kubernetes_role,omitempty"`
+	KubernetesMount string `json:"kubernetes_mount,omitempty"`
+
+	TransitMount string `json:"transit_mount,omitempty"`
+	KeyName      string `json:"key_name,omitempty"`
+
+	// Context is optional base64 "context" data passed to Transit for
+	// derived/convergent keys. Most setups leave this empty.
+	Context string `json:"context,omitempty"`
+}
+
+// vaultTransit wraps a logged-in Vault client and the coordinates of the
+// Transit key used to encrypt/decrypt storage values.
+type vaultTransit struct {
+	cfg    *VaultConfig
+	client *vault.Client
+	logger *zap.SugaredLogger
+}
+
+func newVaultTransit(ctx caddy.Context, cfg *VaultConfig, logger *zap.SugaredLogger) (*vaultTransit, error) {
+	if cfg.TransitMount == "" {
+		return nil, fmt.Errorf("vault: transit_mount is required")
+	}
+	if cfg.KeyName == "" {
+		return nil, fmt.Errorf("vault: key_name is required")
+	}
+
+	vc := vault.DefaultConfig()
+	if cfg.Address != "" {
+		vc.Address = cfg.Address
+	}
+
+	client, err := vault.NewClient(vc)
+	if err != nil {
+		return nil, fmt.Errorf("vault: unable to create client: %w", err)
+	}
+
+	vt := &vaultTransit{cfg: cfg, client: client, logger: logger}
+
+	if err := vt.login(ctx); err != nil {
+		return nil, err
+	}
+
+	return vt, nil
+}
+
+// login authenticates against Vault using the configured auth method and
+// starts a background goroutine that renews the resulting token before it
+// expires, for as long as ctx is alive.
+func (vt *vaultTransit) login(ctx caddy.Context) error {
+	switch vt.cfg.AuthMethod {
+	case "", VaultAuthToken:
+		token := vt.cfg.Token
+		if token == "" {
+			token = os.Getenv(vault.EnvVaultToken)
+		}
+		if token == "" {
+			return fmt.Errorf("vault: no token provided for token auth")
+		}
+		vt.client.SetToken(token)
+
+		self, err := vt.client.Auth().Token().LookupSelf()
+		if err != nil {
+			return fmt.Errorf("vault: unable to look up configured token: %w", err)
+		}
+		renewable, err := self.TokenIsRenewable()
+		if err != nil {
+			return fmt.Errorf("vault: unable to read renewable flag for configured token: %w", err)
+		}
+		if !renewable {
+			// Non-renewable tokens (root tokens, periodic tokens with no
+			// TTL, etc.) are the caller's responsibility to keep valid;
+			// there is nothing for us to renew in the background.
+			return nil
+		}
+		ttl, err := self.TokenTTL()
+		if err != nil {
+			return fmt.Errorf("vault: unable to read TTL for configured token: %w", err)
+		}
+
+		vt.startRenewal(ctx, &vault.Secret{
+			Auth: &vault.SecretAuth{
+				ClientToken: token,
+				Renewable:   true,
+			},
+			LeaseDuration: int(ttl.Seconds()),
+		})
+		return nil
+
+	case VaultAuthAppRole:
+		roleID := os.Getenv(EnvNameVaultRoleID)
+		secretID := os.Getenv(EnvNameVaultSecretID)
+		if roleID == "" || secretID == "" {
+			return fmt.Errorf("vault: %s and %s must be set for approle auth", EnvNameVaultRoleID, EnvNameVaultSecretID)
+		}
+
+		mount := vt.cfg.AppRoleMount
+		if mount == "" {
+			mount = "approle"
+		}
+
+		secret, err := vt.client.Logical().Write(fmt.Sprintf("auth/%s/login", mount), map[string]interface{}{
+			"role_id":   roleID,
+			"secret_id": secretID,
+		})
+		if err != nil {
+			return fmt.Errorf("vault: approle login failed: %w", err)
+		}
+		return vt.applyLoginSecret(ctx, secret)
+
+	case VaultAuthKubernetes:
+		jwt, err := os.ReadFile(kubernetesJWTPath)
+		if err != nil {
+			return fmt.Errorf("vault: unable to read kubernetes service account token: %w", err)
+		}
+
+		mount := vt.cfg.KubernetesMount
+		if mount == "" {
+			mount = "kubernetes"
+		}
+
+		secret, err := vt.client.Logical().Write(fmt.Sprintf("auth/%s/login", mount), map[string]interface{}{
+			"role": vt.cfg.KubernetesRole,
+			"jwt":  string(jwt),
+		})
+		if err != nil {
+			return fmt.Errorf("vault: kubernetes login failed: %w", err)
+		}
+		return vt.applyLoginSecret(ctx, secret)
+
+	default:
+		return fmt.Errorf("vault: unknown auth_method %q", vt.cfg.AuthMethod)
+	}
+}
+
+func (vt *vaultTransit) applyLoginSecret(ctx caddy.Context, secret *vault.Secret) error {
+	if secret == nil || secret.Auth == nil {
+		return fmt.Errorf("vault: login returned no auth info")
+	}
+	vt.client.SetToken(secret.Auth.ClientToken)
+	vt.startRenewal(ctx, secret)
+	return nil
+}
+
+// startRenewal keeps the current token alive in the background until ctx is
+// canceled, re-authenticating from scratch if renewal is ultimately
+// refused (e.g. the token hit its max TTL).
+func (vt *vaultTransit) startRenewal(ctx caddy.Context, secret *vault.Secret) {
+	watcher, err := vt.client.NewLifetimeWatcher(&vault.LifetimeWatcherInput{
+		Secret: secret,
+	})
+	if err != nil {
+		vt.logger.Errorw("vault: unable to start token renewal watcher", "error", err)
+		return
+	}
+
+	go watcher.Start()
+
+	go func() {
+		defer watcher.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err := <-watcher.DoneCh():
+				if err != nil {
+					vt.logger.Warnw("vault: token renewal stopped, re-authenticating", "error", err)
+				}
+				// Back off briefly so a persistently unreachable Vault
+				// doesn't spin this goroutine hot.
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(5 * time.Second):
+				}
+				if err := vt.login(ctx); err != nil {
+					vt.logger.Errorw("vault: re-authentication failed", "error", err)
+				}
+				return
+			case <-watcher.RenewCh():
+				vt.logger.Debugw("vault: token renewed")
+			}
+		}
+	}()
+}
+
+func (vt *vaultTransit) encryptPath() string {
+	return fmt.Sprintf("%s/encrypt/%s", vt.cfg.TransitMount, vt.cfg.KeyName)
+}
+
+func (vt *vaultTransit) decryptPath() string {
+	return fmt.Sprintf("%s/decrypt/%s", vt.cfg.TransitMount, vt.cfg.KeyName)
+}
+
+func (vt *vaultTransit) rewrapPath() string {
+	return fmt.Sprintf("%s/rewrap/%s", vt.cfg.TransitMount, vt.cfg.KeyName)
+}
+
+func (vt *vaultTransit) encrypt(plaintext []byte) ([]byte, error) {
+	data := map[string]interface{}{
+		"plaintext": base64.StdEncoding.EncodeToString(plaintext),
+	}
+	if vt.cfg.Context != "" {
+		data["context"] = vt.cfg.Context
+	}
+
+	secret, err := vt.client.Logical().Write(vt.encryptPath(), data)
+	if err != nil {
+		return nil, fmt.Errorf("vault: transit encrypt failed: %w", err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("vault: transit encrypt returned no data")
+	}
+
+	ciphertext, ok := secret.Data["ciphertext"].(string)
+	if !ok {
+		return nil, fmt.Errorf("vault: transit encrypt response missing ciphertext")
+	}
+
+	return []byte(ciphertext), nil
+}
+
+func (vt *vaultTransit) decrypt(ciphertext []byte) ([]byte, error) {
+	data := map[string]interface{}{
+		"ciphertext": string(ciphertext),
+	}
+	if vt.cfg.Context != "" {
+		data["context"] = vt.cfg.Context
+	}
+
+	secret, err := vt.client.Logical().Write(vt.decryptPath(), data)
+	if err != nil {
+		return nil, fmt.Errorf("vault: transit decrypt failed: %w", err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("vault: transit decrypt returned no data")
+	}
+
+	encoded, ok := secret.Data["plaintext"].(string)
+	if !ok {
+		return nil, fmt.Errorf("vault: transit decrypt response missing plaintext")
+	}
+
+	plaintext, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("vault: unable to decode plaintext: %w", err)
+	}
+
+	return plaintext, nil
+}
+
+// rewrap asks Vault to re-encrypt ciphertext under the Transit key's
+// current version without ever exposing the plaintext to Caddy.
+func (vt *vaultTransit) rewrap(ciphertext []byte) ([]byte, error) {
+	data := map[string]interface{}{
+		"ciphertext": string(ciphertext),
+	}
+	if vt.cfg.Context != "" {
+		data["context"] = vt.cfg.Context
+	}
+
+	secret, err := vt.client.Logical().Write(vt.rewrapPath(), data)
+	if err != nil {
+		return nil, fmt.Errorf("vault: transit rewrap failed: %w", err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("vault: transit rewrap returned no data")
+	}
+
+	rewrapped, ok := secret.Data["ciphertext"].(string)
+	if !ok {
+		return nil, fmt.Errorf("vault: transit rewrap response missing ciphertext")
+	}
+
+	return []byte(rewrapped), nil
+}
+
+// RewrapVault walks every key under the storage prefix and re-encrypts its
+// raw value through Vault's transit/rewrap endpoint. Unlike Store/Load this
+// never decrypts the value locally, so the plaintext never leaves Vault.
+// Lock markers (.lock) are skipped: Lock writes them with an empty value,
+// which isn't valid Transit ciphertext and would otherwise fail every
+// rewrap on a tree that has ever held a distributed lock. Chunk fragments
+// are real Transit ciphertext and are rewrapped like any other key.
+func (cs *ConsulStorage) RewrapVault(ctx context.Context) error {
+	if cs.vault == nil {
+		return fmt.Errorf("vault backend is not configured")
+	}
+
+	basePrefix := cs.Prefix + "/"
+	keys, _, err := cs.ConsulClient.KV().Keys(basePrefix, "", nil)
+	if err != nil {
+		return fmt.Errorf("unable to list keys under %s: %w", cs.Prefix, err)
+	}
+
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if isLockKey(strings.TrimPrefix(key, basePrefix)) {
+			continue
+		}
+
+		kvPair, _, err := cs.ConsulClient.KV().Get(key, nil)
+		if err != nil {
+			return fmt.Errorf("unable to load %s: %w", key, err)
+		}
+		if kvPair == nil {
+			continue
+		}
+
+		rewrapped, err := cs.vault.rewrap(kvPair.Value)
+		if err != nil {
+			return fmt.Errorf("unable to rewrap %s: %w", key, err)
+		}
+
+		_, err = cs.ConsulClient.KV().Put(&consul.KVPair{
+			Key:   key,
+			Value: rewrapped,
+		}, nil)
+		if err != nil {
+			return fmt.Errorf("unable to store rewrapped value for %s: %w", key, err)
+		}
+	}
+
+	return nil
+}
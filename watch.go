@@ -0,0 +1,251 @@
+package storageconsul
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	consul "github.com/hashicorp/consul/api"
+	"go.uber.org/zap"
+)
+
+// EventType describes what happened to a key in a Subscribe stream.
+type EventType int
+
+const (
+	EventCreate EventType = iota
+	EventUpdate
+	EventDelete
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventCreate:
+		return "create"
+	case EventUpdate:
+		return "update"
+	case EventDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is emitted by Subscribe whenever a key under the watched prefix is
+// created, updated or deleted.
+type Event struct {
+	Type        EventType
+	Key         string
+	ModifyIndex uint64
+}
+
+// Subscriber is implemented by storage backends that can push change
+// notifications for a key prefix. It is an extension on top of
+// certmagic.Storage: callers that need it type-assert for Subscriber
+// rather than it being part of the core interface.
+type Subscriber interface {
+	Subscribe(ctx context.Context, prefix string) (<-chan Event, error)
+}
+
+var _ Subscriber = (*ConsulStorage)(nil)
+
+const (
+	watchMinBackoff = time.Second
+	watchMaxBackoff = 30 * time.Second
+	watchWaitTime   = 5 * time.Minute
+)
+
+// Subscribe streams create/update/delete events for everything under
+// prefix, using Consul's blocking query API so changes made by other nodes
+// in the cluster (e.g. a certificate issued elsewhere) surface with
+// millisecond latency instead of polling.
+func (cs *ConsulStorage) Subscribe(ctx context.Context, prefix string) (<-chan Event, error) {
+	if cs.ConsulClient == nil {
+		return nil, fmt.Errorf("consul client is not provisioned")
+	}
+	return watchPrefix(ctx, cs.ConsulClient, cs.prefixedKey(prefix), cs.logger), nil
+}
+
+// watchPrefix spawns the long-poll goroutine backing Subscribe. It survives
+// Consul leader elections by retrying with backoff on any query error, and
+// stops for good once ctx is canceled.
+func watchPrefix(ctx context.Context, client *consul.Client, prefix string, logger *zap.SugaredLogger) <-chan Event {
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	events := make(chan Event)
+
+	go func() {
+		defer close(events)
+
+		var lastIndex uint64
+		prevModifyIndex := make(map[string]uint64)
+		backoff := watchMinBackoff
+		first := true
+
+		for {
+			if ctx.Err() != nil {
+				return
+			}
+
+			opts := (&consul.QueryOptions{
+				WaitIndex: lastIndex,
+				WaitTime:  watchWaitTime,
+			}).WithContext(ctx)
+
+			pairs, meta, err := client.KV().List(prefix, opts)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				if logger != nil {
+					logger.Warnw("consul watch: query failed, retrying", "prefix", prefix, "error", err, "backoff", backoff)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				backoff *= 2
+				if backoff > watchMaxBackoff {
+					backoff = watchMaxBackoff
+				}
+				continue
+			}
+			backoff = watchMinBackoff
+
+			// A lower index than we last saw means the Consul cluster's
+			// Raft index was reset (e.g. restored from a snapshot); start
+			// over rather than blocking on a WaitIndex that may never
+			// recur.
+			if meta.LastIndex < lastIndex {
+				lastIndex = 0
+			} else {
+				lastIndex = meta.LastIndex
+			}
+
+			currentModifyIndex := make(map[string]uint64, len(pairs))
+			for _, pair := range pairs {
+				currentModifyIndex[pair.Key] = pair.ModifyIndex
+
+				if first {
+					continue
+				}
+
+				oldIndex, existed := prevModifyIndex[pair.Key]
+				switch {
+				case !existed:
+					if !sendEvent(ctx, events, Event{Type: EventCreate, Key: pair.Key, ModifyIndex: pair.ModifyIndex}) {
+						return
+					}
+				case oldIndex != pair.ModifyIndex:
+					if !sendEvent(ctx, events, Event{Type: EventUpdate, Key: pair.Key, ModifyIndex: pair.ModifyIndex}) {
+						return
+					}
+				}
+			}
+
+			if !first {
+				for key, oldIndex := range prevModifyIndex {
+					if _, stillThere := currentModifyIndex[key]; !stillThere {
+						if !sendEvent(ctx, events, Event{Type: EventDelete, Key: key, ModifyIndex: oldIndex}) {
+							return
+						}
+					}
+				}
+			}
+
+			prevModifyIndex = currentModifyIndex
+			first = false
+		}
+	}()
+
+	return events
+}
+
+func sendEvent(ctx context.Context, events chan<- Event, ev Event) bool {
+	select {
+	case events <- ev:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func init() {
+	caddy.RegisterModule(&WatchApp{})
+}
+
+// WatchApp exposes Consul's blocking-query watch as a Caddy app, so
+// non-TLS consumers (other Caddy modules) can watch arbitrary Consul KV
+// subtrees through its Subscribe method without pulling in the certificate
+// storage machinery. It registers no admin API route.
+type WatchApp struct {
+	Address string `json:"address,omitempty"`
+	Token   string `json:"token,omitempty"`
+
+	client *consul.Client
+	logger *zap.SugaredLogger
+}
+
+// CaddyModule returns the Caddy module information.
+func (*WatchApp) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "consul_watch",
+		New: func() caddy.Module { return new(WatchApp) },
+	}
+}
+
+// Provision sets up the Consul client used for watches.
+func (a *WatchApp) Provision(ctx caddy.Context) error {
+	a.logger = ctx.Logger().Sugar()
+
+	config := consul.DefaultConfig()
+	if a.Address != "" {
+		config.Address = a.Address
+	}
+	if a.Token != "" {
+		config.Token = a.Token
+	} else if token := os.Getenv(consul.HTTPTokenEnvName); token != "" {
+		config.Token = token
+	}
+
+	client, err := consul.NewClient(config)
+	if err != nil {
+		return fmt.Errorf("unable to create consul client: %w", err)
+	}
+	a.client = client
+
+	return nil
+}
+
+// Start implements caddy.App. There is no listener to start; watches are
+// spawned on demand by Subscribe.
+func (a *WatchApp) Start() error {
+	return nil
+}
+
+// Stop implements caddy.App. Active Subscribe calls are stopped by
+// canceling the context they were given, not by Stop.
+func (a *WatchApp) Stop() error {
+	return nil
+}
+
+// Subscribe streams events for an arbitrary Consul KV subtree, independent
+// of any certificate storage configuration.
+func (a *WatchApp) Subscribe(ctx context.Context, prefix string) (<-chan Event, error) {
+	if a.client == nil {
+		return nil, fmt.Errorf("consul client is not provisioned")
+	}
+	return watchPrefix(ctx, a.client, prefix, a.logger), nil
+}
+
+var (
+	_ caddy.App         = (*WatchApp)(nil)
+	_ caddy.Provisioner = (*WatchApp)(nil)
+	_ Subscriber        = (*WatchApp)(nil)
+)